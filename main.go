@@ -1,29 +1,147 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
+// keyFrameInterval is how often we ask every publishing peer for a fresh
+// keyframe, so a late-joining subscriber isn't stuck staring at a grey box
+// until the next one happens naturally.
+const keyFrameInterval = 3 * time.Second
+
+var defaultICEServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+var iceConfigPath = flag.String("ice", "", "path to a JSON file with ICE server configuration (STUN/TURN), defaults to Google's public STUN server")
+
+var (
+	iceServersOnce sync.Once
+	iceServers     []webrtc.ICEServer
+)
+
+// loadICEServers parses -ice on first use and caches the result for every
+// subsequent PeerConnection. A missing or invalid file is logged and falls
+// back to defaultICEServers rather than aborting the server.
+func loadICEServers() []webrtc.ICEServer {
+	iceServersOnce.Do(func() {
+		iceServers = defaultICEServers
+
+		if *iceConfigPath == "" {
+			return
+		}
+
+		data, err := os.ReadFile(*iceConfigPath)
+		if err != nil {
+			log.Println("ICE config not loaded, falling back to default STUN server:", err)
+			return
+		}
+
+		var servers []webrtc.ICEServer
+		if err := json.Unmarshal(data, &servers); err != nil {
+			log.Println("ICE config is not valid JSON, falling back to default STUN server:", err)
+			return
+		}
+
+		iceServers = servers
+	})
+	return iceServers
+}
+
 type Client struct {
-	ws          *websocket.Conn
+	ws          *threadSafeWriter
 	pc          *webrtc.PeerConnection
 	isInitiator bool
 }
 
+// threadSafeWriter serializes writes to a single WebSocket connection.
+// gorilla/websocket allows only one concurrent writer per connection, but a
+// client's PeerConnection callbacks (OnICECandidate, renegotiation) and the
+// room's signaling pass can all want to write to it at the same time.
+// Reads are still only ever done from the connection's own read loop, so
+// ReadJSON is left unguarded via the embedded *websocket.Conn.
+type threadSafeWriter struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (w *threadSafeWriter) WriteJSON(v any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Conn.WriteJSON(v)
+}
+
+// wsMessage is the envelope every signaling message is wrapped in, so offers,
+// answers, ICE candidates and room events can share one WebSocket connection
+// without the ad-hoc "does it have a candidate field" sniffing we used to do.
+type wsMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// send wraps payload in a wsMessage and writes it to ws.
+func send(ws *threadSafeWriter, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return ws.WriteJSON(wsMessage{Event: event, Data: data})
+}
+
+// Room groups the peers that were connected with the same room ID and the
+// tracks currently being forwarded between them. Membership changes
+// (join/leave) and track registrations are comparatively rare next to the
+// PLI dispatcher's periodic reads, hence the RWMutex.
+type Room struct {
+	id      string
+	mu      sync.RWMutex
+	clients []*Client
+	tracks  map[string]*remoteTrack
+}
+
+// remoteTrack is one track registered in a room: the local track every
+// subscriber's PeerConnection forwards to, plus enough of the original
+// remote track to request keyframes from its publisher.
+type remoteTrack struct {
+	local   *webrtc.TrackLocalStaticRTP
+	remote  *webrtc.TrackRemote
+	ownerPC *webrtc.PeerConnection
+}
+
 var (
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
-	mu      sync.Mutex
-	clients []*Client
+	roomsMu sync.Mutex
+	rooms   = map[string]*Room{}
 )
 
+// getRoom returns the room for id, creating it on first use.
+func getRoom(id string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	room, ok := rooms[id]
+	if !ok {
+		room = &Room{id: id, tracks: map[string]*remoteTrack{}}
+		rooms[id] = room
+	}
+	return room
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("index.html")
 	if err != nil {
@@ -34,26 +152,35 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.Parse()
+
 	http.HandleFunc("/call", indexHandler)
 	http.HandleFunc("/ws", wsHandler)
 
+	go keyFrameDispatcher()
+
 	log.Println("SFU running on https://0.0.0.0:8080")
 	log.Fatal(http.ListenAndServeTLS(":8080", "cert.pem", "key.pem", nil))
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WS upgrade error:", err)
 		return
 	}
+	ws := &threadSafeWriter{Conn: conn}
 	defer ws.Close()
-	log.Println("New client connected")
+
+	roomID := r.URL.Query().Get("room")
+	if roomID == "" {
+		roomID = "default"
+	}
+	room := getRoom(roomID)
+	log.Println("New client connected to room:", roomID)
 
 	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+		ICEServers: loadICEServers(),
 	})
 	if err != nil {
 		log.Println("Failed to create PeerConnection:", err)
@@ -62,51 +189,23 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{ws: ws, pc: pc}
 
-	mu.Lock()
-	if len(clients) >= 2 {
-		mu.Unlock()
-		ws.WriteJSON(map[string]string{"error": "room is full"})
-		return
-	}
-	client.isInitiator = len(clients) == 0
-	clients = append(clients, client)
-	mu.Unlock()
-
-	ws.WriteJSON(map[string]any{
-		"type":         "role",
-		"initiator":    client.isInitiator,
-		"participants": len(clients),
-	})
-
-	defer cleanup(client)
-
-	// После создания pc
+	// Register every PeerConnection handler before this peer can be touched
+	// by room signaling: SetLocalDescription starts ICE gathering as soon as
+	// signalPeerConnections renegotiates it below, and candidates gathered
+	// before OnICECandidate is wired up are lost for good.
 	pc.OnNegotiationNeeded(func() {
-		if pc.SignalingState() != webrtc.SignalingStateStable {
-			log.Println("Skipping renegotiation, signaling state:", pc.SignalingState())
-			return
-		}
-
-		offer, err := pc.CreateOffer(nil)
-		if err != nil {
-			log.Println("CreateOffer failed:", err)
-			return
-		}
-		if err := pc.SetLocalDescription(offer); err != nil {
-			log.Println("SetLocalDescription failed:", err)
-			return
-		}
-		mu.Lock()
-		ws.WriteJSON(offer)
-		mu.Unlock()
+		room.signalPeerConnections()
 	})
 
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c != nil {
-			mu.Lock()
-			ws.WriteJSON(c.ToJSON())
-			mu.Unlock()
+		if c == nil {
+			// End of candidates: signal it with an empty ICECandidateInit,
+			// the same way a browser does on onicecandidate(null).
+			send(ws, "candidate", webrtc.ICECandidateInit{})
+			return
 		}
+		init := c.ToJSON()
+		send(ws, "candidate", init)
 	})
 
 	pc.OnConnectionStateChange(func(status webrtc.PeerConnectionState) {
@@ -116,131 +215,301 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
 		log.Println("Track received:", track.Kind())
 
-		mu.Lock()
-		defer mu.Unlock()
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+		if err != nil {
+			log.Println("Error creating local track:", err)
+			return
+		}
 
-		for _, other := range clients {
-			if other == client {
-				continue // не отправляем себе
+		room.mu.Lock()
+		room.tracks[track.ID()] = &remoteTrack{local: localTrack, remote: track, ownerPC: pc}
+		room.mu.Unlock()
+		room.signalPeerConnections()
+
+		defer func() {
+			room.mu.Lock()
+			delete(room.tracks, track.ID())
+			room.mu.Unlock()
+			room.signalPeerConnections()
+		}()
+
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := track.Read(buf)
+			if err != nil {
+				log.Println("Read:", err)
+				return
 			}
 
-			// Проверяем, что трек ещё не добавлен
-			alreadyAdded := false
-			for _, sender := range other.pc.GetSenders() {
-				if sender.Track() != nil && sender.Track().ID() == track.ID()+"-"+other.ws.RemoteAddr().String() {
-					alreadyAdded = true
-					break
-				}
-			}
-			if alreadyAdded {
-				continue
+			if _, err := localTrack.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Println("Write:", err)
+				return
 			}
+		}
+	})
 
-			// Создаём уникальные TrackID и StreamID для каждого клиента
-			trackID := track.ID() + "-" + other.ws.RemoteAddr().String()
-			streamID := track.StreamID() + "-" + other.ws.RemoteAddr().String()
+	room.mu.Lock()
+	client.isInitiator = len(room.clients) == 0
+	room.clients = append(room.clients, client)
+	participants := len(room.clients)
+	room.mu.Unlock()
 
-			localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, trackID, streamID)
-			if err != nil {
-				log.Println("Error creating local track:", err)
-				continue
-			}
+	send(ws, "join", map[string]any{
+		"initiator":    client.isInitiator,
+		"participants": participants,
+	})
 
-			_, err = other.pc.AddTrack(localTrack)
-			if err != nil {
-				log.Println("Error adding track:", err)
-				continue
-			}
+	// Subscribe the newcomer to every track already flowing in the room and renegotiate.
+	room.signalPeerConnections()
 
-			go func(tRemote *webrtc.TrackRemote, tLocal *webrtc.TrackLocalStaticRTP) {
-				buf := make([]byte, 1500)
-				for {
-					n, _, err := tRemote.Read(buf)
-					if err != nil {
-						log.Println("Read:", err)
-						return
-					}
-					if _, err := tLocal.Write(buf[:n]); err != nil {
-						log.Println("Write:", err)
-						return
-					}
-				}
-			}(track, localTrack)
-		}
-	})
+	defer cleanup(room, client)
 
 	for {
-		var msg map[string]any
+		var msg wsMessage
 		if err := ws.ReadJSON(&msg); err != nil {
 			log.Println("ReadJSON:", err)
 			return
 		}
 
-		if msg["type"] != nil {
-			sdp := webrtc.SessionDescription{
-				Type: webrtc.NewSDPType(msg["type"].(string)),
-				SDP:  msg["sdp"].(string),
+		switch msg.Event {
+		case "offer", "answer":
+			var sdp webrtc.SessionDescription
+			if err := json.Unmarshal(msg.Data, &sdp); err != nil {
+				log.Println("Invalid SDP payload:", err)
+				continue
 			}
 
-			if err = pc.SetRemoteDescription(sdp); err != nil {
+			if err := pc.SetRemoteDescription(sdp); err != nil {
 				log.Println("SetRemoteDescription:", err)
+				continue
 			}
 
 			if sdp.Type == webrtc.SDPTypeOffer {
 				answer, err := pc.CreateAnswer(nil)
 				if err != nil {
 					log.Println("CreateAnswer:", err)
+					continue
 				}
 
-				if err = pc.SetLocalDescription(answer); err != nil {
+				if err := pc.SetLocalDescription(answer); err != nil {
 					log.Println("SetLocalDescription:", err)
+					continue
+				}
+
+				send(ws, "answer", answer)
+			}
+
+		case "candidate":
+			var candidate webrtc.ICECandidateInit
+			if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+				log.Println("Invalid ICE candidate payload:", err)
+				continue
+			}
+
+			if candidate.Candidate == "" {
+				// End of candidates from the client, nothing to add.
+				continue
+			}
+
+			if err := pc.AddICECandidate(candidate); err != nil {
+				log.Println("AddICECandidate:", err)
+			}
+
+		case "leave":
+			log.Println("Client sent leave")
+			return
+
+		default:
+			log.Println("Unknown signaling event:", msg.Event)
+		}
+	}
+}
+
+// pendingOffer is an offer that's ready to go out over the wire once
+// signalPeerConnections has released room.mu.
+type pendingOffer struct {
+	peer  *Client
+	offer webrtc.SessionDescription
+}
+
+// signalPeerConnections reconciles every peer's senders against the room's
+// track registry: senders for tracks no longer in the registry are dropped,
+// senders for registry entries the peer doesn't have yet are added, and each
+// peer is renegotiated. Mutating a peer's senders or signaling state may
+// race with a concurrent renegotiation already in flight, so the whole pass
+// is retried until nothing changes, with a capped number of immediate
+// attempts falling back to a delayed retry.
+//
+// The actual WriteJSON for each offer happens after room.mu is released, so
+// one peer with a stalled WebSocket write can't block join/leave/track
+// registration for the rest of the room.
+func (room *Room) signalPeerConnections() {
+	var pending []pendingOffer
+
+	room.mu.Lock()
+
+	attemptSync := func() (tryAgain bool) {
+		pending = pending[:0]
+
+		for i := 0; i < len(room.clients); i++ {
+			peer := room.clients[i]
+
+			if peer.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				room.clients = append(room.clients[:i], room.clients[i+1:]...)
+				return true
+			}
+
+			existing := map[string]bool{}
+			for _, sender := range peer.pc.GetSenders() {
+				if sender.Track() == nil {
+					continue
 				}
+				id := sender.Track().ID()
+				existing[id] = true
 
-				mu.Lock()
-				if err = ws.WriteJSON(answer); err != nil {
-					log.Println("WriteJSON:", err)
+				if _, ok := room.tracks[id]; !ok {
+					if err := peer.pc.RemoveTrack(sender); err != nil {
+						log.Println("RemoveTrack:", err)
+					}
 				}
-				mu.Unlock()
 			}
-		} else if msg["candidate"] != nil {
-			err = pc.AddICECandidate(webrtc.ICECandidateInit{
-				Candidate: msg["candidate"].(string),
-			})
+
+			// Don't subscribe a peer to its own tracks.
+			for _, receiver := range peer.pc.GetReceivers() {
+				if receiver.Track() != nil {
+					existing[receiver.Track().ID()] = true
+				}
+			}
+
+			for id, t := range room.tracks {
+				if existing[id] {
+					continue
+				}
+
+				sender, err := peer.pc.AddTrack(t.local)
+				if err != nil {
+					log.Println("AddTrack:", err)
+					continue
+				}
+				go drainRTCP(sender)
+
+				if t.remote.Kind() == webrtc.RTPCodecTypeVideo {
+					sendPLI(t)
+				}
+			}
+
+			if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+				return true
+			}
+
+			offer, err := peer.pc.CreateOffer(nil)
 			if err != nil {
-				log.Println("AddICECandidate:", err)
+				log.Println("CreateOffer:", err)
+				return true
 			}
+			if err := peer.pc.SetLocalDescription(offer); err != nil {
+				log.Println("SetLocalDescription:", err)
+				return true
+			}
+			pending = append(pending, pendingOffer{peer: peer, offer: offer})
+		}
+		return false
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt == 25 {
+			room.mu.Unlock()
+			go func() {
+				time.Sleep(3 * time.Second)
+				room.signalPeerConnections()
+			}()
+			return
+		}
+		if !attemptSync() {
+			break
+		}
+	}
+
+	room.mu.Unlock()
+
+	for _, p := range pending {
+		if err := send(p.peer.ws, "offer", p.offer); err != nil {
+			log.Println("WriteJSON:", err)
 		}
 	}
 }
 
-func renegotiate(c *Client) {
-	offer, err := c.pc.CreateOffer(nil)
-	if err != nil {
-		log.Println("Failed to create offer:", err)
-		return
+// drainRTCP reads (and discards) RTCP packets off sender so the pion
+// transport doesn't stall waiting for them to be consumed.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
 	}
+}
 
-	if err = c.pc.SetLocalDescription(offer); err != nil {
-		log.Println("SetLocalDescription:", err)
+// sendPLI asks t's owner for an immediate keyframe.
+func sendPLI(t *remoteTrack) {
+	err := t.ownerPC.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(t.remote.SSRC())},
+	})
+	if err != nil {
+		log.Println("WriteRTCP(PLI):", err)
 	}
+}
 
-	if err = c.ws.WriteJSON(offer); err != nil {
-		log.Println("WriteJSON:", err)
+// keyFrameDispatcher periodically requests a keyframe from every publishing
+// peer in every room, so that video keeps recovering even without a new
+// subscriber joining.
+func keyFrameDispatcher() {
+	ticker := time.NewTicker(keyFrameInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		roomsMu.Lock()
+		allRooms := make([]*Room, 0, len(rooms))
+		for _, room := range rooms {
+			allRooms = append(allRooms, room)
+		}
+		roomsMu.Unlock()
+
+		for _, room := range allRooms {
+			room.mu.RLock()
+			for _, t := range room.tracks {
+				if t.remote.Kind() == webrtc.RTPCodecTypeVideo {
+					sendPLI(t)
+				}
+			}
+			room.mu.RUnlock()
+		}
 	}
 }
 
-func cleanup(c *Client) {
-	mu.Lock()
-	defer mu.Unlock()
+func cleanup(room *Room, c *Client) {
 	log.Println("Client disconnected")
 
 	c.pc.Close()
 	c.ws.Close()
 
-	for i, cl := range clients {
+	// roomsMu is always taken before room.mu so we can drop the room from the
+	// registry in the same critical section as checking it's now empty,
+	// without racing a concurrent getRoom/join for the same ID.
+	roomsMu.Lock()
+	room.mu.Lock()
+	for i, cl := range room.clients {
 		if cl == c {
-			clients = append(clients[:i], clients[i+1:]...)
+			room.clients = append(room.clients[:i], room.clients[i+1:]...)
 			break
 		}
 	}
+	empty := len(room.clients) == 0
+	room.mu.Unlock()
+	if empty {
+		delete(rooms, room.id)
+	}
+	roomsMu.Unlock()
+
+	room.signalPeerConnections()
 }